@@ -0,0 +1,173 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"context"
+	"encoding/binary"
+
+	"github.com/pingcap/errors"
+)
+
+// ErrBatchSnapshotReadOnly is returned by every mutating method of
+// BatchSnapshot: a batch snapshot is shared, read-only state and must never
+// be made dirty by one of its concurrent readers.
+var ErrBatchSnapshotReadOnly = errors.New("kv: BatchSnapshot is read-only")
+
+// StalenessBound describes how far behind "now" the read timestamp picked for
+// a BatchSnapshot is allowed to be.
+type StalenessBound struct {
+	// MaxTimestamp upper-bounds the read timestamp; the zero value means "as
+	// of now".
+	MaxTimestamp uint64
+	// MinTimestamp lower-bounds the read timestamp, so a stale read never
+	// goes further back than this.
+	MinTimestamp uint64
+	// ExactStaleness, when non-zero, asks for a read exactly this many
+	// milliseconds older than now; MinTimestamp and MaxTimestamp are still
+	// checked against the timestamp it picks.
+	ExactStaleness int64
+}
+
+// batchSnapshotToken is the serialized form of a BatchSnapshot: everything a
+// worker needs in order to reopen the exact same view of the store with
+// OpenBatchSnapshot, without asking the oracle for a new timestamp.
+type batchSnapshotToken struct {
+	StartTS       uint64
+	SchemaVersion int64
+	Scope         string
+}
+
+// BatchSnapshot is a read-only, single-TS view of the store that can be
+// shared across processes by marshalling it to a token. Workers that open the
+// same token via OpenBatchSnapshot read from the same startTS and share no
+// mutable state with each other or with the coordinator that created it.
+type BatchSnapshot struct {
+	token batchSnapshotToken
+	txn   Transaction
+}
+
+// NewBatchSnapshot wraps txn, which must have been opened at startTS, into a
+// BatchSnapshot carrying the given schema version and scope.
+func NewBatchSnapshot(txn Transaction, startTS uint64, schemaVersion int64, scope string) *BatchSnapshot {
+	return &BatchSnapshot{
+		token: batchSnapshotToken{
+			StartTS:       startTS,
+			SchemaVersion: schemaVersion,
+			Scope:         scope,
+		},
+		txn: txn,
+	}
+}
+
+// OpenBatchSnapshot reopens a BatchSnapshot from a token produced by Marshal,
+// without issuing a new timestamp request against store's oracle.
+func OpenBatchSnapshot(store Storage, token []byte) (*BatchSnapshot, error) {
+	tok, err := unmarshalBatchSnapshotToken(token)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	txn, err := store.BeginWithStartTS(tok.StartTS)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &BatchSnapshot{token: tok, txn: txn}, nil
+}
+
+// StartTS returns the timestamp every worker sharing this snapshot reads at.
+func (b *BatchSnapshot) StartTS() uint64 {
+	return b.token.StartTS
+}
+
+// SchemaVersion returns the schema version the snapshot was opened with.
+func (b *BatchSnapshot) SchemaVersion() int64 {
+	return b.token.SchemaVersion
+}
+
+// Scope returns the scope the snapshot was bound to, e.g. a partitioned key
+// range a worker should restrict its Iter calls to.
+func (b *BatchSnapshot) Scope() string {
+	return b.token.Scope
+}
+
+// Get overrides the Retriever interface.
+func (b *BatchSnapshot) Get(k Key) ([]byte, error) {
+	return b.txn.Get(k)
+}
+
+// Iter overrides the Retriever interface.
+func (b *BatchSnapshot) Iter(k Key, upperBound Key) (Iterator, error) {
+	return b.txn.Iter(k, upperBound)
+}
+
+// IterReverse overrides the Retriever interface.
+func (b *BatchSnapshot) IterReverse(k Key) (Iterator, error) {
+	return b.txn.IterReverse(k)
+}
+
+// Commit always fails: a BatchSnapshot is read-only.
+func (b *BatchSnapshot) Commit(ctx context.Context) error {
+	return errors.Trace(ErrBatchSnapshotReadOnly)
+}
+
+// Set always fails: a BatchSnapshot is read-only.
+func (b *BatchSnapshot) Set(k Key, v []byte) error {
+	return errors.Trace(ErrBatchSnapshotReadOnly)
+}
+
+// Delete always fails: a BatchSnapshot is read-only.
+func (b *BatchSnapshot) Delete(k Key) error {
+	return errors.Trace(ErrBatchSnapshotReadOnly)
+}
+
+// Marshal serializes the snapshot into the opaque token that a coordinator
+// hands out to worker processes.
+func (b *BatchSnapshot) Marshal() ([]byte, error) {
+	scope := []byte(b.token.Scope)
+	buf := make([]byte, 8+8+2+len(scope))
+	binary.BigEndian.PutUint64(buf[0:8], b.token.StartTS)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(b.token.SchemaVersion))
+	binary.BigEndian.PutUint16(buf[16:18], uint16(len(scope)))
+	copy(buf[18:], scope)
+	return buf, nil
+}
+
+// Unmarshal restores a token produced by Marshal. Unlike OpenBatchSnapshot, it
+// does not open a transaction; callers that only need StartTS/SchemaVersion/
+// Scope (e.g. to partition work) can use this without touching the store.
+func (b *BatchSnapshot) Unmarshal(token []byte) error {
+	tok, err := unmarshalBatchSnapshotToken(token)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	b.token = tok
+	return nil
+}
+
+func unmarshalBatchSnapshotToken(token []byte) (batchSnapshotToken, error) {
+	if len(token) < 18 {
+		return batchSnapshotToken{}, errors.Errorf("kv: invalid BatchSnapshot token of length %d", len(token))
+	}
+	startTS := binary.BigEndian.Uint64(token[0:8])
+	schemaVersion := int64(binary.BigEndian.Uint64(token[8:16]))
+	scopeLen := int(binary.BigEndian.Uint16(token[16:18]))
+	if len(token) != 18+scopeLen {
+		return batchSnapshotToken{}, errors.Errorf("kv: invalid BatchSnapshot token of length %d", len(token))
+	}
+	return batchSnapshotToken{
+		StartTS:       startTS,
+		SchemaVersion: schemaVersion,
+		Scope:         string(token[18 : 18+scopeLen]),
+	}, nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package kv
+
+import (
+	"testing"
+
+	"github.com/pingcap/errors"
+)
+
+func TestBatchSnapshotMarshalUnmarshalRoundTrip(t *testing.T) {
+	want := &BatchSnapshot{
+		token: batchSnapshotToken{
+			StartTS:       421339938816000001,
+			SchemaVersion: 42,
+			Scope:         "dc-1",
+		},
+	}
+
+	token, err := want.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	got := &BatchSnapshot{}
+	if err := got.Unmarshal(token); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+
+	if got.StartTS() != want.StartTS() {
+		t.Errorf("StartTS = %d, want %d", got.StartTS(), want.StartTS())
+	}
+	if got.SchemaVersion() != want.SchemaVersion() {
+		t.Errorf("SchemaVersion = %d, want %d", got.SchemaVersion(), want.SchemaVersion())
+	}
+	if got.Scope() != want.Scope() {
+		t.Errorf("Scope = %q, want %q", got.Scope(), want.Scope())
+	}
+}
+
+func TestBatchSnapshotUnmarshalRejectsTruncatedToken(t *testing.T) {
+	want := &BatchSnapshot{
+		token: batchSnapshotToken{StartTS: 1, SchemaVersion: 1, Scope: "dc-1"},
+	}
+	token, err := want.Marshal()
+	if err != nil {
+		t.Fatalf("Marshal: %v", err)
+	}
+
+	got := &BatchSnapshot{}
+	if err := got.Unmarshal(token[:len(token)-1]); err == nil {
+		t.Fatalf("expected Unmarshal to reject a truncated token")
+	}
+}
+
+func TestBatchSnapshotMutationsReturnErrBatchSnapshotReadOnly(t *testing.T) {
+	b := &BatchSnapshot{}
+	if err := errors.Cause(b.Set(Key("k"), []byte("v"))); err != ErrBatchSnapshotReadOnly {
+		t.Errorf("Set: got %v, want ErrBatchSnapshotReadOnly", err)
+	}
+	if err := errors.Cause(b.Delete(Key("k"))); err != ErrBatchSnapshotReadOnly {
+		t.Errorf("Delete: got %v, want ErrBatchSnapshotReadOnly", err)
+	}
+	if err := errors.Cause(b.Commit(nil)); err != ErrBatchSnapshotReadOnly {
+		t.Errorf("Commit: got %v, want ErrBatchSnapshotReadOnly", err)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/store/tikv/oracle"
+	log "github.com/sirupsen/logrus"
+)
+
+// BeginBatchReadOnly opens a kv.BatchSnapshot bound by the given staleness
+// bound, the way START TRANSACTION READ ONLY WITH BOUND SNAPSHOT does. The
+// returned snapshot can be marshalled to a token and handed to worker
+// processes, which reopen it with kv.OpenBatchSnapshot and run disjoint Iter/
+// Get calls over it in parallel: none of them issues a new timestamp request,
+// and none can accidentally mutate the shared view.
+//
+// bound.ExactStaleness, when set, picks the read timestamp directly instead
+// of asking the oracle for the current one; bound.MinTimestamp/MaxTimestamp
+// are enforced against whichever timestamp is picked, so a caller asking for
+// a stale read gets an error rather than a silently fresh snapshot.
+func (s *session) BeginBatchReadOnly(ctx context.Context, bound kv.StalenessBound) (*kv.BatchSnapshot, error) {
+	var (
+		txn kv.Transaction
+		err error
+	)
+	if bound.ExactStaleness > 0 {
+		staleTime := time.Now().Add(-time.Duration(bound.ExactStaleness) * time.Millisecond)
+		staleTS := oracle.ComposeTS(oracle.GetPhysical(staleTime), 0)
+		txn, err = s.store.BeginWithStartTS(staleTS)
+	} else {
+		future := s.getTxnFuture(ctx)
+		txn, err = future.wait()
+	}
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	startTS := txn.StartTS()
+	if err := checkStalenessBound(bound, startTS); err != nil {
+		// The transaction is otherwise unused from here on; roll it back
+		// rather than leaving it orphaned on the store holding its view open.
+		if err1 := txn.Rollback(); err1 != nil {
+			log.Error(err1)
+		}
+		return nil, err
+	}
+	schemaVersion := s.GetSessionVars().TxnCtx.SchemaVersion
+	return kv.NewBatchSnapshot(txn, startTS, schemaVersion, s.GetSessionVars().TxnScope), nil
+}
+
+// checkStalenessBound reports whether startTS falls within bound, the same
+// check BeginBatchReadOnly used to run inline; factored out so it can be unit
+// tested without a session/store fixture.
+func checkStalenessBound(bound kv.StalenessBound, startTS uint64) error {
+	if bound.MinTimestamp != 0 && startTS < bound.MinTimestamp {
+		return errors.Errorf("kv: no snapshot available within bound [%d, %d]", bound.MinTimestamp, bound.MaxTimestamp)
+	}
+	if bound.MaxTimestamp != 0 && startTS > bound.MaxTimestamp {
+		return errors.Errorf("kv: no snapshot available within bound [%d, %d]", bound.MinTimestamp, bound.MaxTimestamp)
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package metrics holds the Prometheus metrics for session.TxnState. It is
+// kept separate from package session so that lower-level packages session
+// depends on (e.g. executor) can also record into it without creating an
+// import cycle back into session.
+//
+// Surfacing this data through INFORMATION_SCHEMA.TIDB_TRX_STATS, as operators
+// without a Prometheus scraper would want, needs a virtual-table reader
+// registered with the infoschema package; that registration plumbing isn't
+// part of this package and is left for whoever wires up the SQL surface.
+package metrics
+
+import "github.com/prometheus/client_golang/prometheus"
+
+const (
+	namespace = "tidb"
+	subsystem = "session_txn"
+)
+
+var (
+	// TxnBufferSize tracks TxnState.buf.Len() for the in-progress statement
+	// buffer of each live session.
+	TxnBufferSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "buffer_size",
+		Help:      "Number of entries in the current statement's buffered writes.",
+	}, []string{"session_id", "user"})
+
+	// TxnMutationsCount tracks len(TxnState.mutations).
+	TxnMutationsCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "mutations_count",
+		Help:      "Number of tables with pending binlog mutations.",
+	}, []string{"session_id", "user"})
+
+	// TxnDirtyTableOPCount tracks len(TxnState.dirtyTableOP).
+	TxnDirtyTableOPCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "dirty_table_op_count",
+		Help:      "Number of pending dirty-table operations.",
+	}, []string{"session_id", "user"})
+
+	// StmtCommitDuration times session.StmtCommit.
+	StmtCommitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "stmt_commit_duration_seconds",
+		Help:      "Bucketed histogram of StmtCommit latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 18),
+	}, []string{"session_id", "user"})
+
+	// TxnCommitDuration times TxnState.Commit.
+	TxnCommitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "commit_duration_seconds",
+		Help:      "Bucketed histogram of transaction Commit latency.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 18),
+	}, []string{"session_id", "user"})
+
+	// TxnWaitDuration times txnFuture.wait, i.e. time blocked waiting for a
+	// start timestamp.
+	TxnWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "wait_duration_seconds",
+		Help:      "Bucketed histogram of time spent blocked in txnFuture.wait.",
+		Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 18),
+	}, []string{"session_id", "user"})
+
+	// TxnDoNotCommitTotal counts how often StmtCommit poisoned the
+	// transaction via TxnState.doNotCommit.
+	TxnDoNotCommitTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "do_not_commit_total",
+		Help:      "Number of times StmtCommit poisoned the transaction.",
+	}, []string{"session_id", "user"})
+
+	// TxnRetryTotal counts retry attempts kicked off by session.RunInTxn.
+	TxnRetryTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "retry_total",
+		Help:      "Number of retries RunInTxn has kicked off.",
+	}, []string{"session_id", "user"})
+
+	// TxnGetTSErrorTotal counts txnFuture.wait failures to obtain a start
+	// timestamp, broken down by error class.
+	TxnGetTSErrorTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: subsystem,
+		Name:      "get_ts_error_total",
+		Help:      "Number of failures to obtain a start timestamp, by error class.",
+	}, []string{"class"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		TxnBufferSize,
+		TxnMutationsCount,
+		TxnDirtyTableOPCount,
+		StmtCommitDuration,
+		TxnCommitDuration,
+		TxnWaitDuration,
+		TxnDoNotCommitTotal,
+		TxnRetryTotal,
+		TxnGetTSErrorTotal,
+	)
+}
+
+// DeleteSession removes every series labelled for sessionID/user, so a long-
+// lived Prometheus scrape doesn't accumulate stale series for sessions that
+// have since closed or reset their transaction state.
+func DeleteSession(sessionID, user string) {
+	TxnBufferSize.DeleteLabelValues(sessionID, user)
+	TxnMutationsCount.DeleteLabelValues(sessionID, user)
+	TxnDirtyTableOPCount.DeleteLabelValues(sessionID, user)
+	StmtCommitDuration.DeleteLabelValues(sessionID, user)
+	TxnCommitDuration.DeleteLabelValues(sessionID, user)
+	TxnWaitDuration.DeleteLabelValues(sessionID, user)
+	TxnDoNotCommitTotal.DeleteLabelValues(sessionID, user)
+	TxnRetryTotal.DeleteLabelValues(sessionID, user)
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestDeleteSessionRemovesEveryLabelledSeries checks that DeleteSession
+// removes the session's series from each per-session metric listed below; a
+// metric missing from DeleteSession would leak a stale series for every
+// session that has ever touched it. Metrics not listed here are not checked.
+func TestDeleteSessionRemovesEveryLabelledSeries(t *testing.T) {
+	const sessionID, user = "123", "root"
+
+	TxnBufferSize.WithLabelValues(sessionID, user).Set(1)
+	TxnMutationsCount.WithLabelValues(sessionID, user).Set(1)
+	TxnDirtyTableOPCount.WithLabelValues(sessionID, user).Set(1)
+	StmtCommitDuration.WithLabelValues(sessionID, user).Observe(1)
+	TxnCommitDuration.WithLabelValues(sessionID, user).Observe(1)
+	TxnWaitDuration.WithLabelValues(sessionID, user).Observe(1)
+	TxnDoNotCommitTotal.WithLabelValues(sessionID, user).Inc()
+	TxnRetryTotal.WithLabelValues(sessionID, user).Inc()
+
+	if n := testutil.CollectAndCount(TxnBufferSize); n == 0 {
+		t.Fatalf("setup: expected TxnBufferSize to have a series before DeleteSession")
+	}
+
+	DeleteSession(sessionID, user)
+
+	checks := []struct {
+		name string
+		n    int
+	}{
+		{"TxnBufferSize", testutil.CollectAndCount(TxnBufferSize)},
+		{"TxnMutationsCount", testutil.CollectAndCount(TxnMutationsCount)},
+		{"TxnDirtyTableOPCount", testutil.CollectAndCount(TxnDirtyTableOPCount)},
+		{"StmtCommitDuration", testutil.CollectAndCount(StmtCommitDuration)},
+		{"TxnCommitDuration", testutil.CollectAndCount(TxnCommitDuration)},
+		{"TxnWaitDuration", testutil.CollectAndCount(TxnWaitDuration)},
+		{"TxnDoNotCommitTotal", testutil.CollectAndCount(TxnDoNotCommitTotal)},
+		{"TxnRetryTotal", testutil.CollectAndCount(TxnRetryTotal)},
+	}
+	for _, c := range checks {
+		if c.n != 0 {
+			t.Errorf("%s: expected DeleteSession to remove the %s/%s series, %d left", c.name, sessionID, user, c.n)
+		}
+	}
+}
@@ -0,0 +1,229 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/session/metrics"
+)
+
+// BackoffConfig controls the exponential backoff RunInTxn sleeps through
+// between retries.
+type BackoffConfig struct {
+	// Base is the delay before the first retry.
+	Base time.Duration
+	// Cap upper-bounds every computed delay, however many attempts have
+	// already been made.
+	Cap time.Duration
+	// Jitter spreads retries out so that a batch of sessions that all start
+	// retrying at once don't all wake up together.
+	Jitter bool
+	// MaxAttempts caps the number of times fn is run. Zero means unlimited.
+	MaxAttempts int
+}
+
+// DefaultBackoffConfig is the backoff RunInTxn uses when RunInTxnOptions
+// leaves Backoff at its zero value.
+func DefaultBackoffConfig() BackoffConfig {
+	return BackoffConfig{
+		Base:        10 * time.Millisecond,
+		Cap:         1 * time.Second,
+		Jitter:      true,
+		MaxAttempts: 10,
+	}
+}
+
+// sleep blocks for the backoff delay of the given attempt (1-based) or until
+// ctx is done, and returns that delay; when ctx ends the wait early, the full
+// delay is still returned.
+func (c BackoffConfig) sleep(ctx context.Context, attempt int) time.Duration {
+	d := c.Base << uint(attempt-1)
+	if d <= 0 || d > c.Cap {
+		d = c.Cap
+	}
+	if c.Jitter {
+		d = time.Duration(rand.Int63n(int64(d) + 1))
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return d
+}
+
+// RunInTxnOptions configures RunInTxn.
+type RunInTxnOptions struct {
+	// Pessimistic selects pessimistic locking for the transaction; the zero
+	// value runs optimistic transactions.
+	Pessimistic bool
+	// Deadline, if non-zero, stops retrying once reached, even if attempts
+	// remain under MaxAttempts.
+	Deadline time.Time
+	// RefreshStartTS asks RunInTxn to fetch a fresh txnFuture on every retry
+	// instead of reusing the one from the failed attempt.
+	RefreshStartTS bool
+	// Backoff overrides DefaultBackoffConfig.
+	Backoff BackoffConfig
+}
+
+// RunInTxnStats reports how much work a RunInTxn call did, for callers that
+// want to log or export retry behaviour.
+type RunInTxnStats struct {
+	Attempts       int
+	BackoffSlept   time.Duration
+	LastErrorClass string
+}
+
+// RunInTxnError is returned by RunInTxn once it gives up retrying.
+type RunInTxnError struct {
+	Stats RunInTxnStats
+	Err   error
+}
+
+func (e *RunInTxnError) Error() string {
+	return fmt.Sprintf("session: RunInTxn failed after %d attempt(s), last error class %s: %v",
+		e.Stats.Attempts, e.Stats.LastErrorClass, e.Err)
+}
+
+// Cause implements the github.com/pingcap/errors Causer interface.
+func (e *RunInTxnError) Cause() error {
+	return e.Err
+}
+
+// deadlineExceeded reports whether opts.Deadline has passed. A zero Deadline
+// means "no deadline" and is never exceeded.
+func deadlineExceeded(deadline time.Time) bool {
+	return !deadline.IsZero() && time.Now().After(deadline)
+}
+
+func isRetryableError(err error) bool {
+	return errors.Cause(err) == kv.ErrRetryable
+}
+
+func errorClass(err error) string {
+	if err == nil {
+		return ""
+	}
+	return fmt.Sprintf("%T", errors.Cause(err))
+}
+
+// shouldRetry decides whether RunInTxn should attempt again after err on the
+// given attempt: err must be retryable, attempts must remain under
+// cfg.MaxAttempts (zero means unlimited), and deadline must not have passed.
+func shouldRetry(err error, attempt int, cfg BackoffConfig, deadline time.Time) bool {
+	if !isRetryableError(err) {
+		return false
+	}
+	if cfg.MaxAttempts != 0 && attempt == cfg.MaxAttempts {
+		return false
+	}
+	if deadlineExceeded(deadline) {
+		return false
+	}
+	return true
+}
+
+func (s *session) recordRetryKick() {
+	sessionID := strconv.FormatUint(s.GetSessionVars().ConnectionID, 10)
+	metrics.TxnRetryTotal.WithLabelValues(sessionID, s.GetSessionVars().User.Username).Inc()
+}
+
+// RunInTxn runs fn inside a transaction managed through the session's usual
+// TxnState/txnFuture machinery, committing via StmtCommit then Commit, and
+// retrying with exponential backoff on retryable errors from the txnFuture,
+// StmtCommit or Commit. It removes the retry-loop boilerplate that callers
+// otherwise hand-roll around kv.RunInNewTxn.
+func (s *session) RunInTxn(ctx context.Context, opts RunInTxnOptions, fn func(kv.Transaction) error) error {
+	cfg := opts.Backoff
+	if cfg.Base == 0 && cfg.Cap == 0 && cfg.MaxAttempts == 0 {
+		cfg = DefaultBackoffConfig()
+	}
+
+	var (
+		stats   RunInTxnStats
+		lastErr error
+		future  *txnFuture
+	)
+	for attempt := 1; cfg.MaxAttempts == 0 || attempt <= cfg.MaxAttempts; attempt++ {
+		// The deadline only bounds retries, not the first attempt: a caller
+		// that races a tight Deadline against clock skew still gets fn run
+		// once, rather than an error that never called fn at all.
+		if attempt > 1 && deadlineExceeded(opts.Deadline) {
+			break
+		}
+		stats.Attempts = attempt
+
+		if future == nil || opts.RefreshStartTS {
+			future = s.getTxnFuture(ctx)
+		}
+		s.txn.changeInvalidToPending(future)
+		if err := s.txn.changePendingToValid(kv.DefaultTxnMembufCap); err != nil {
+			lastErr = err
+			stats.LastErrorClass = errorClass(err)
+			future = nil
+			if !shouldRetry(err, attempt, cfg, opts.Deadline) {
+				break
+			}
+			s.recordRetryKick()
+			stats.BackoffSlept += cfg.sleep(ctx, attempt)
+			continue
+		}
+		if opts.Pessimistic {
+			s.txn.SetOption(kv.Pessimistic, true)
+		}
+
+		runErr := fn(&s.txn)
+		if runErr == nil {
+			// COMMIT implicitly releases any savepoints fn left open, merging
+			// their buffered writes down to the current layer so StmtCommit's
+			// flush below actually reaches the real transaction.
+			runErr = s.txn.releaseAllSavepoints()
+		}
+		if runErr == nil {
+			runErr = s.StmtCommit()
+		}
+		if runErr == nil {
+			runErr = s.txn.Commit(ctx)
+		}
+		if runErr == nil {
+			return nil
+		}
+
+		lastErr = runErr
+		stats.LastErrorClass = errorClass(runErr)
+		// Roll back rather than just resetting bookkeeping: fn or StmtCommit
+		// may have left the real transaction holding pessimistic locks, and
+		// those must be released before the next attempt (or giving up)
+		// discards our reference to it.
+		s.txn.rollbackOrReset()
+		if !shouldRetry(runErr, attempt, cfg, opts.Deadline) {
+			break
+		}
+		s.recordRetryKick()
+		stats.BackoffSlept += cfg.sleep(ctx, attempt)
+		if opts.RefreshStartTS {
+			future = nil
+		}
+	}
+	return &RunInTxnError{Stats: stats, Err: lastErr}
+}
@@ -0,0 +1,96 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/kv"
+)
+
+// TestDeadlineExceeded checks the deadlineExceeded helper RunInTxn consults
+// before every attempt after the first: a zero Deadline never expires, a past
+// one has expired and a future one has not. RunInTxn's own loop, which skips
+// the check on attempt 1, is not exercised here.
+func TestDeadlineExceeded(t *testing.T) {
+	if deadlineExceeded(time.Time{}) {
+		t.Errorf("zero Deadline must mean \"no deadline\"")
+	}
+	if !deadlineExceeded(time.Now().Add(-time.Minute)) {
+		t.Errorf("a Deadline in the past must be reported as exceeded")
+	}
+	if deadlineExceeded(time.Now().Add(time.Minute)) {
+		t.Errorf("a Deadline in the future must not be reported as exceeded")
+	}
+}
+
+func TestBackoffConfigSleepRespectsCap(t *testing.T) {
+	cfg := BackoffConfig{Base: time.Millisecond, Cap: 5 * time.Millisecond, Jitter: false}
+	for attempt := 1; attempt <= 10; attempt++ {
+		// Attempt grows past where Base<<attempt would overflow Cap if sleep
+		// didn't clamp it, so this exercises the real clamp, not a
+		// reimplementation of it.
+		d := cfg.sleep(context.Background(), attempt)
+		if d > cfg.Cap {
+			t.Fatalf("attempt %d: slept %s, want at most Cap %s", attempt, d, cfg.Cap)
+		}
+	}
+}
+
+func TestErrorClassEmptyForNilError(t *testing.T) {
+	if got := errorClass(nil); got != "" {
+		t.Errorf("errorClass(nil) = %q, want empty string", got)
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	retryable := errors.Trace(kv.ErrRetryable)
+	nonRetryable := errors.New("not retryable")
+	future := time.Now().Add(time.Hour)
+	past := time.Now().Add(-time.Hour)
+
+	cases := []struct {
+		name     string
+		err      error
+		attempt  int
+		cfg      BackoffConfig
+		deadline time.Time
+		want     bool
+	}{
+		{"retryable with attempts and time left", retryable, 1, BackoffConfig{MaxAttempts: 3}, future, true},
+		{"non-retryable error never retries", nonRetryable, 1, BackoffConfig{MaxAttempts: 3}, future, false},
+		{"last attempt does not retry", retryable, 3, BackoffConfig{MaxAttempts: 3}, future, false},
+		{"unlimited attempts keep retrying", retryable, 1000, BackoffConfig{MaxAttempts: 0}, future, true},
+		{"past deadline does not retry", retryable, 1, BackoffConfig{MaxAttempts: 3}, past, false},
+		{"zero deadline means no deadline", retryable, 1, BackoffConfig{MaxAttempts: 3}, time.Time{}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := shouldRetry(c.err, c.attempt, c.cfg, c.deadline); got != c.want {
+				t.Errorf("shouldRetry(%v, %d, %+v, %v) = %v, want %v", c.err, c.attempt, c.cfg, c.deadline, got, c.want)
+			}
+		})
+	}
+}
+
+// RunInTxn itself drives TxnState/txnFuture/kv.Storage through a real
+// *session, none of which this snapshot defines (there is no session.go
+// here) or vendors (kv.Storage/kv.Transaction are external interfaces of
+// unknown shape), so it cannot be exercised end-to-end from this package.
+// shouldRetry and BackoffConfig.sleep above cover the decision logic RunInTxn
+// delegates to; rollbackOrReset's invalid-transaction branch is exercised by
+// TxnState's own tests in txn_test.go, its Valid() branch is not.
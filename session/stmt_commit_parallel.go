@@ -0,0 +1,185 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"hash/fnv"
+	"runtime"
+	"sync"
+
+	"github.com/pingcap/errors"
+	"github.com/pingcap/tidb/kv"
+)
+
+// defaultStmtCommitParallelThreshold is the buffered-key count above which
+// StmtCommit switches from its sequential flush to the parallel one, unless
+// tidb_stmt_commit_parallel_threshold overrides it.
+const defaultStmtCommitParallelThreshold = 256
+
+// bufEntry is one key/value pair read out of TxnState.buf; value being empty
+// means the key was deleted, matching kv.WalkMemBuffer's convention.
+type bufEntry struct {
+	key   kv.Key
+	value []byte
+}
+
+// SetCommitParallelism configures the fan-out StmtCommit's flush uses.
+// workers mirrors the tidb_stmt_commit_parallel session variable: 0 disables
+// the parallel path, a negative value means "use GOMAXPROCS", a positive
+// value forces that many workers. threshold mirrors
+// tidb_stmt_commit_parallel_threshold: the sequential path is kept below it
+// regardless of workers, defaultStmtCommitParallelThreshold is used when it
+// is not positive.
+func (st *TxnState) SetCommitParallelism(workers, threshold int) {
+	st.commitParallel = workers
+	st.commitParallelThreshold = threshold
+}
+
+// resolveCommitParallelism returns how many workers flushBuf should use to
+// flush pending buffered keys, or 0/1 for the sequential path.
+func (st *TxnState) resolveCommitParallelism(pending int) int {
+	if st.commitParallel == 0 {
+		return 0
+	}
+	threshold := st.commitParallelThreshold
+	if threshold <= 0 {
+		threshold = defaultStmtCommitParallelThreshold
+	}
+	if pending < threshold {
+		return 0
+	}
+	n := st.commitParallel
+	if n < 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	if n > pending {
+		n = pending
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// flushBuf writes every key buffered in st.buf into st.Transaction, using the
+// parallel fan-out when the buffer is large enough and tidb_stmt_commit_parallel
+// allows it, and the plain sequential walk otherwise.
+func (st *TxnState) flushBuf() error {
+	var entries []bufEntry
+	err := kv.WalkMemBuffer(st.buf, func(k kv.Key, v []byte) error {
+		entries = append(entries, bufEntry{key: append(kv.Key(nil), k...), value: v})
+		return nil
+	})
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	if n := st.resolveCommitParallelism(len(entries)); n > 1 {
+		return st.flushBufParallel(entries, n)
+	}
+	return st.flushBufSequential(entries)
+}
+
+func (st *TxnState) flushBufSequential(entries []bufEntry) error {
+	var count int
+	for _, e := range entries {
+
+		// gofail: var mockStmtCommitError bool
+		// if mockStmtCommitError {
+		// 	count++
+		// }
+		if count > 3 {
+			return errors.New("mock stmt commit error")
+		}
+
+		if len(e.value) == 0 {
+			if err := st.Transaction.Delete(e.key); err != nil {
+				return errors.Trace(err)
+			}
+			continue
+		}
+		if err := st.Transaction.Set(e.key, e.value); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// flushBufParallel partitions entries into n batches by key hash and flushes
+// each batch on its own goroutine into a private staging kv.MemBuffer, mirroring
+// the fan-out/collect-first-error shape of txnCommitter.doBatches. kv.MemBuffer
+// is not guaranteed safe for concurrent writers, so workers never touch
+// st.Transaction directly; the staging buffers are merged into it serially,
+// in batch order, once every worker has finished.
+func (st *TxnState) flushBufParallel(entries []bufEntry, n int) error {
+	batches := partitionBufEntries(entries, n)
+	stagings := make([]kv.MemBuffer, n)
+	errCh := make(chan error, n)
+
+	var wg sync.WaitGroup
+	for i, batch := range batches {
+		staging := kv.NewMemDbBuffer(kv.DefaultTxnMembufCap)
+		stagings[i] = staging
+		wg.Add(1)
+		go func(batch []bufEntry, staging kv.MemBuffer) {
+			defer wg.Done()
+			for _, e := range batch {
+				var err error
+				if len(e.value) == 0 {
+					err = staging.Delete(e.key)
+				} else {
+					err = staging.Set(e.key, e.value)
+				}
+				if err != nil {
+					errCh <- errors.Trace(err)
+					return
+				}
+			}
+		}(batch, staging)
+	}
+	wg.Wait()
+	close(errCh)
+	if err, ok := <-errCh; ok {
+		return err
+	}
+
+	// Flushing the staging buffers into the real transaction, and the binlog
+	// mutation merge that follows in StmtCommit, both happen serially, so no
+	// two goroutines write st.Transaction or bin.Mutations at the same time.
+	for _, staging := range stagings {
+		err := kv.WalkMemBuffer(staging, func(k kv.Key, v []byte) error {
+			if len(v) == 0 {
+				return errors.Trace(st.Transaction.Delete(k))
+			}
+			return errors.Trace(st.Transaction.Set(k, v))
+		})
+		if err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// partitionBufEntries splits entries into n batches by hashing each key, so
+// that a key-range hotspot in the buffer doesn't overload a single worker.
+func partitionBufEntries(entries []bufEntry, n int) [][]bufEntry {
+	batches := make([][]bufEntry, n)
+	for _, e := range entries {
+		h := fnv.New32a()
+		_, _ = h.Write(e.key)
+		idx := int(h.Sum32() % uint32(n))
+		batches[idx] = append(batches[idx], e)
+	}
+	return batches
+}
@@ -17,12 +17,15 @@ import (
 	"context"
 	"fmt"
 	"runtime/debug"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
 	"github.com/pingcap/errors"
 	"github.com/pingcap/tidb/executor"
 	"github.com/pingcap/tidb/kv"
+	"github.com/pingcap/tidb/session/metrics"
 	"github.com/pingcap/tidb/sessionctx"
 	"github.com/pingcap/tidb/sessionctx/binloginfo"
 	"github.com/pingcap/tidb/store/tikv/oracle"
@@ -48,9 +51,64 @@ type TxnState struct {
 	mutations    map[int64]*binlog.TableMutation
 	dirtyTableOP []dirtyTableOperation
 
+	// savepoints holds one savepointRecord per SQL SAVEPOINT that is still live,
+	// in the order they were created. buf/mutations/dirtyTableOP above always
+	// hold the layer that is currently being written to, i.e. the top of the stack.
+	savepoints []savepointRecord
+
 	// If doNotCommit is not nil, Commit() will not commit the transaction.
 	// doNotCommit flag may be set when StmtCommit fail.
 	doNotCommit error
+
+	// sessionID/user label the metrics in package session/metrics; they are
+	// kept on TxnState, rather than looked up from *session each time,
+	// because Commit/reset do not have a *session to hand.
+	sessionID uint64
+	user      string
+
+	// commitParallel/commitParallelThreshold configure StmtCommit's flush
+	// fan-out; see SetCommitParallelism.
+	commitParallel          int
+	commitParallelThreshold int
+}
+
+// bindMetricsLabels records the session identity TxnState's Prometheus
+// metrics should be labelled with.
+func (st *TxnState) bindMetricsLabels(sessionID uint64, user string) {
+	st.sessionID = sessionID
+	st.user = user
+}
+
+func (st *TxnState) metricsLabels() (string, string) {
+	return strconv.FormatUint(st.sessionID, 10), st.user
+}
+
+// txnLayer groups the three buffers that together make up one level of a
+// TxnState's savepoint stack.
+type txnLayer struct {
+	buf          kv.MemBuffer
+	mutations    map[int64]*binlog.TableMutation
+	dirtyTableOP []dirtyTableOperation
+}
+
+// savepointRecord is the state of the transaction for one open SAVEPOINT.
+// frozen is a snapshot of the transaction as it was when the SAVEPOINT
+// statement ran; it is never written to again, so ROLLBACK TO SAVEPOINT can
+// always restore exactly it. frontier accumulates every statement committed
+// since, one StmtCommit fold at a time; RollbackToSavepoint discards it
+// without touching frozen, and ReleaseSavepoint merges it into frozen.
+type savepointRecord struct {
+	name     string
+	frozen   txnLayer
+	frontier txnLayer
+}
+
+// newTxnLayer returns an empty txnLayer, ready to be written to.
+func newTxnLayer() txnLayer {
+	return txnLayer{
+		buf:       kv.NewMemDbBuffer(kv.DefaultTxnMembufCap),
+		mutations: make(map[int64]*binlog.TableMutation),
+	}
 }
 
 var _ kv.SafeStore = &TxnState{}
@@ -159,7 +217,12 @@ type dirtyTableOperation struct {
 
 // Commit overrides the Transaction interface.
 func (st *TxnState) Commit(ctx context.Context) error {
+	sessionID, user := st.metricsLabels()
+	start := time.Now()
 	defer st.reset()
+	defer func() {
+		metrics.TxnCommitDuration.WithLabelValues(sessionID, user).Observe(time.Since(start).Seconds())
+	}()
 	if len(st.mutations) != 0 || len(st.dirtyTableOP) != 0 || st.buf.Len() != 0 {
 		log.Errorf("The code should never run here, TxnState=%#v, mutations=%#v, dirtyTableOP=%#v, buf=%#v something must be wrong: %s",
 			st,
@@ -191,15 +254,214 @@ func (st *TxnState) Rollback() error {
 	return errors.Trace(st.Transaction.Rollback())
 }
 
+// rollbackOrReset releases a failed attempt's backing transaction: it rolls
+// the real transaction back if it is still valid, so pessimistic locks it
+// holds are released, or just resets TxnState's own bookkeeping if Commit
+// already did so (Commit resets unconditionally, even when the underlying
+// Transaction.Commit call itself is what failed). RunInTxn calls this between
+// attempts instead of resetting directly.
+func (st *TxnState) rollbackOrReset() {
+	if st.Valid() {
+		if err := st.Rollback(); err != nil {
+			log.Error(err)
+		}
+		return
+	}
+	st.reset()
+}
+
 func (st *TxnState) reset() {
 	st.doNotCommit = nil
 	st.cleanup()
+	st.savepoints = nil
 	st.changeToInvalid()
+	sessionID, user := st.metricsLabels()
+	metrics.DeleteSession(sessionID, user)
+}
+
+// Savepoint implements the SQL SAVEPOINT statement. It freezes whatever the
+// enclosing scope had accumulated so far (the outermost savepoint's frozen
+// layer is empty, since everything before it has already been flushed to the
+// real transaction) and gives the new savepoint a fresh, empty frontier for
+// statements to fold into from now on.
+func (st *TxnState) Savepoint(name string) {
+	var frozen txnLayer
+	if n := len(st.savepoints); n > 0 {
+		top := &st.savepoints[n-1]
+		frozen = top.frontier
+		top.frontier = newTxnLayer()
+	} else {
+		frozen = newTxnLayer()
+	}
+	st.savepoints = append(st.savepoints, savepointRecord{
+		name:     name,
+		frozen:   frozen,
+		frontier: newTxnLayer(),
+	})
+}
+
+// findSavepoint returns the index of the most recently created savepoint with
+// the given name, matching MySQL's behaviour when a name is reused.
+func (st *TxnState) findSavepoint(name string) (int, bool) {
+	for i := len(st.savepoints) - 1; i >= 0; i-- {
+		if st.savepoints[i].name == name {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// RollbackToSavepoint implements the SQL ROLLBACK TO SAVEPOINT statement: it
+// discards every layer above the named savepoint, so all writes made since it
+// was created are undone, including writes already folded into the named
+// savepoint's own frontier by earlier StmtCommits. Unlike ReleaseSavepoint,
+// the named savepoint's frozen layer is left untouched and it stays on the
+// stack: MySQL lets it be rolled back to, or released, again afterwards.
+func (st *TxnState) RollbackToSavepoint(name string) error {
+	idx, ok := st.findSavepoint(name)
+	if !ok {
+		return errors.Errorf("SAVEPOINT %s does not exist", name)
+	}
+	st.savepoints = st.savepoints[:idx+1]
+	st.savepoints[idx].frontier = newTxnLayer()
+	st.buf = kv.NewMemDbBuffer(kv.DefaultTxnMembufCap)
+	st.mutations = make(map[int64]*binlog.TableMutation)
+	st.dirtyTableOP = nil
+	return nil
+}
+
+// ReleaseSavepoint implements the SQL RELEASE SAVEPOINT statement. It does not
+// undo anything; it merges the named savepoint's frontier, and any savepoint
+// frontiers above it, down into the named savepoint's frozen layer and
+// forgets about all of them.
+func (st *TxnState) ReleaseSavepoint(name string) error {
+	idx, ok := st.findSavepoint(name)
+	if !ok {
+		return errors.Errorf("SAVEPOINT %s does not exist", name)
+	}
+	for len(st.savepoints) > idx {
+		if err := st.releaseTopSavepoint(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// releaseAllSavepoints collapses every open savepoint into the current layer.
+// It is what COMMIT runs through before the final StmtCommit/Transaction.Commit,
+// since MySQL implicitly releases any savepoints a transaction left open.
+func (st *TxnState) releaseAllSavepoints() error {
+	for len(st.savepoints) > 0 {
+		if err := st.releaseTopSavepoint(); err != nil {
+			return errors.Trace(err)
+		}
+	}
+	return nil
+}
+
+// releaseTopSavepoint pops the most recently created savepoint, merges its
+// frontier into its own frozen layer, and hands that merged layer to whatever
+// scope encloses it: the new top-of-stack's frontier, or, once the stack is
+// empty, the current layer (merged under the current layer's own writes) so
+// the next StmtCommit flushes it like any other unguarded statement.
+func (st *TxnState) releaseTopSavepoint() error {
+	last := len(st.savepoints) - 1
+	top := st.savepoints[last]
+	st.savepoints = st.savepoints[:last]
+
+	if err := mergeLayer(&top.frozen, &top.frontier); err != nil {
+		return errors.Trace(err)
+	}
+
+	if len(st.savepoints) > 0 {
+		st.savepoints[len(st.savepoints)-1].frontier = top.frozen
+	} else {
+		// Writes still sitting in the current layer are the most recent ones;
+		// replay them on top so they are not lost when the layer is replaced.
+		current := txnLayer{buf: st.buf, mutations: st.mutations, dirtyTableOP: st.dirtyTableOP}
+		if err := mergeLayer(&top.frozen, &current); err != nil {
+			return errors.Trace(err)
+		}
+		st.buf = top.frozen.buf
+		st.mutations = top.frozen.mutations
+		st.dirtyTableOP = top.frozen.dirtyTableOP
+	}
+	return nil
+}
+
+// foldCurrentIntoStackTop merges the current statement's layer into the
+// innermost open savepoint's frontier, leaving that savepoint's frozen layer
+// untouched, and hands the current layer a fresh, empty buffer to accumulate
+// the next statement's writes into. StmtCommit calls this once a savepoint is
+// open, instead of flushing straight to the real transaction, so that
+// RollbackToSavepoint can still discard everything folded in since.
+func (st *TxnState) foldCurrentIntoStackTop() error {
+	top := &st.savepoints[len(st.savepoints)-1]
+
+	current := txnLayer{buf: st.buf, mutations: st.mutations, dirtyTableOP: st.dirtyTableOP}
+	if err := mergeLayer(&top.frontier, &current); err != nil {
+		return errors.Trace(err)
+	}
+
+	st.buf = kv.NewMemDbBuffer(kv.DefaultTxnMembufCap)
+	st.mutations = make(map[int64]*binlog.TableMutation)
+	st.dirtyTableOP = nil
+	return nil
+}
+
+// mergeLayer merges src into dst in place: dst keeps its own writes, then
+// replays src's on top so src's writes (the more recent ones) win.
+func mergeLayer(dst, src *txnLayer) error {
+	if err := mergeBufferInto(dst.buf, src.buf); err != nil {
+		return errors.Trace(err)
+	}
+	for tableID, delta := range src.mutations {
+		mutation, ok := dst.mutations[tableID]
+		if !ok {
+			dst.mutations[tableID] = delta
+			continue
+		}
+		mergeToMutation(mutation, delta)
+	}
+	dst.dirtyTableOP = append(dst.dirtyTableOP, src.dirtyTableOP...)
+	return nil
+}
+
+// mergeBufferInto replays every key written in src onto dst, so that later
+// writes in src correctly shadow earlier ones already present in dst.
+func mergeBufferInto(dst, src kv.MemBuffer) error {
+	return kv.WalkMemBuffer(src, func(k kv.Key, v []byte) error {
+		if len(v) == 0 {
+			return errors.Trace(dst.Delete(k))
+		}
+		return errors.Trace(dst.Set(k, v))
+	})
+}
+
+// allBuffers returns the stack of buffers a read needs to check, from the
+// current layer down through every open savepoint's frontier and frozen
+// layer, top (most recently written) first.
+func (st *TxnState) allBuffers() []kv.MemBuffer {
+	buffers := make([]kv.MemBuffer, 0, 2*len(st.savepoints)+1)
+	buffers = append(buffers, st.buf)
+	for i := len(st.savepoints) - 1; i >= 0; i-- {
+		buffers = append(buffers, st.savepoints[i].frontier.buf, st.savepoints[i].frozen.buf)
+	}
+	return buffers
 }
 
 // Get overrides the Transaction interface.
 func (st *TxnState) Get(k kv.Key) ([]byte, error) {
-	val, err := st.buf.Get(k)
+	var (
+		val []byte
+		err error
+	)
+	for _, buf := range st.allBuffers() {
+		val, err = buf.Get(k)
+		if !kv.IsErrNotFound(err) {
+			break
+		}
+	}
 	if kv.IsErrNotFound(err) {
 		val, err = st.Transaction.Get(k)
 		if kv.IsErrNotFound(err) {
@@ -227,28 +489,42 @@ func (st *TxnState) Delete(k kv.Key) error {
 
 // Iter overrides the Transaction interface.
 func (st *TxnState) Iter(k kv.Key, upperBound kv.Key) (kv.Iterator, error) {
-	bufferIt, err := st.buf.Iter(k, upperBound)
+	it, err := st.Transaction.Iter(k, upperBound)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	retrieverIt, err := st.Transaction.Iter(k, upperBound)
-	if err != nil {
-		return nil, errors.Trace(err)
+	buffers := st.allBuffers()
+	for i := len(buffers) - 1; i >= 0; i-- {
+		bufferIt, err := buffers[i].Iter(k, upperBound)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		it, err = kv.NewUnionIter(bufferIt, it, false)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
-	return kv.NewUnionIter(bufferIt, retrieverIt, false)
+	return it, nil
 }
 
 // IterReverse overrides the Transaction interface.
 func (st *TxnState) IterReverse(k kv.Key) (kv.Iterator, error) {
-	bufferIt, err := st.buf.IterReverse(k)
+	it, err := st.Transaction.IterReverse(k)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
-	retrieverIt, err := st.Transaction.IterReverse(k)
-	if err != nil {
-		return nil, errors.Trace(err)
+	buffers := st.allBuffers()
+	for i := len(buffers) - 1; i >= 0; i-- {
+		bufferIt, err := buffers[i].IterReverse(k)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		it, err = kv.NewUnionIter(bufferIt, it, true)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
 	}
-	return kv.NewUnionIter(bufferIt, retrieverIt, true)
+	return it, nil
 }
 
 func (st *TxnState) cleanup() {
@@ -303,12 +579,22 @@ type txnFuture struct {
 	store  kv.Storage
 
 	mockFail bool
+
+	// sessionID/user label TxnWaitDuration; see TxnState.sessionID/user.
+	sessionID uint64
+	user      string
 }
 
 // mockGetTSErrorInRetryOnce use to make sure gofail mockGetTSErrorInRetry only mock get TS error once.
 var mockGetTSErrorInRetryOnce = true
 
 func (tf *txnFuture) wait() (kv.Transaction, error) {
+	sessionID, user := strconv.FormatUint(tf.sessionID, 10), tf.user
+	start := time.Now()
+	defer func() {
+		metrics.TxnWaitDuration.WithLabelValues(sessionID, user).Observe(time.Since(start).Seconds())
+	}()
+
 	if tf.mockFail {
 		return nil, errors.New("mock get timestamp fail")
 	}
@@ -329,6 +615,7 @@ func (tf *txnFuture) wait() (kv.Transaction, error) {
 	}
 
 	// It would retry get timestamp.
+	metrics.TxnGetTSErrorTotal.WithLabelValues(errorClass(err)).Inc()
 	return tf.store.Begin()
 }
 
@@ -340,35 +627,54 @@ func (s *session) getTxnFuture(ctx context.Context) *txnFuture {
 
 	oracleStore := s.store.GetOracle()
 	tsFuture := oracleStore.GetTimestampAsync(ctx)
-	ret := &txnFuture{future: tsFuture, store: s.store}
+	ret := &txnFuture{
+		future:    tsFuture,
+		store:     s.store,
+		sessionID: s.GetSessionVars().ConnectionID,
+		user:      s.GetSessionVars().User.Username,
+	}
 	if x := ctx.Value("mockGetTSFail"); x != nil {
 		ret.mockFail = true
 	}
 	return ret
 }
 
-// StmtCommit implements the sessionctx.Context interface.
+// StmtCommit implements the sessionctx.Context interface. With no savepoint
+// open, it flushes the current statement's layer into the underlying
+// transaction. With a savepoint open, it only folds that layer into the
+// innermost savepoint's frontier; it does not release any savepoint.
 func (s *session) StmtCommit() error {
 	defer s.txn.cleanup()
 	st := &s.txn
-	var count int
-	err := kv.WalkMemBuffer(st.buf, func(k kv.Key, v []byte) error {
-
-		// gofail: var mockStmtCommitError bool
-		// if mockStmtCommitError {
-		// 	count++
-		// }
-		if count > 3 {
-			return errors.New("mock stmt commit error")
+	st.bindMetricsLabels(s.GetSessionVars().ConnectionID, s.GetSessionVars().User.Username)
+	sessionID, user := st.metricsLabels()
+	start := time.Now()
+	defer func() {
+		metrics.StmtCommitDuration.WithLabelValues(sessionID, user).Observe(time.Since(start).Seconds())
+	}()
+	metrics.TxnBufferSize.WithLabelValues(sessionID, user).Set(float64(st.buf.Len()))
+	metrics.TxnMutationsCount.WithLabelValues(sessionID, user).Set(float64(len(st.mutations)))
+	metrics.TxnDirtyTableOPCount.WithLabelValues(sessionID, user).Set(float64(len(st.dirtyTableOP)))
+
+	// While a savepoint is open, this statement's writes must stay buffered at
+	// the TxnState/stack level rather than reach st.Transaction or the global
+	// binlog/dirtyDB state: kv.Transaction has no way to revert them, so they
+	// would be unrecoverable if a later ROLLBACK TO SAVEPOINT needed to undo
+	// them. Fold just this statement's layer into the innermost savepoint and
+	// stop; the stack itself only collapses on RELEASE SAVEPOINT, ROLLBACK TO
+	// SAVEPOINT or the final transaction Commit/Rollback.
+	if len(st.savepoints) > 0 {
+		if err := st.foldCurrentIntoStackTop(); err != nil {
+			st.doNotCommit = err
+			metrics.TxnDoNotCommitTotal.WithLabelValues(sessionID, user).Inc()
+			return errors.Trace(err)
 		}
-
-		if len(v) == 0 {
-			return errors.Trace(st.Transaction.Delete(k))
-		}
-		return errors.Trace(st.Transaction.Set(k, v))
-	})
-	if err != nil {
+		return nil
+	}
+	st.SetCommitParallelism(s.GetSessionVars().StmtCommitParallel, s.GetSessionVars().StmtCommitParallelThreshold)
+	if err := st.flushBuf(); err != nil {
 		st.doNotCommit = err
+		metrics.TxnDoNotCommitTotal.WithLabelValues(sessionID, user).Inc()
 		return errors.Trace(err)
 	}
 
@@ -393,6 +699,21 @@ func (s *session) StmtRollback() {
 	return
 }
 
+// Savepoint implements the SQL SAVEPOINT name statement.
+func (s *session) Savepoint(name string) {
+	s.txn.Savepoint(name)
+}
+
+// RollbackToSavepoint implements the SQL ROLLBACK TO SAVEPOINT name statement.
+func (s *session) RollbackToSavepoint(name string) error {
+	return errors.Trace(s.txn.RollbackToSavepoint(name))
+}
+
+// ReleaseSavepoint implements the SQL RELEASE SAVEPOINT name statement.
+func (s *session) ReleaseSavepoint(name string) error {
+	return errors.Trace(s.txn.ReleaseSavepoint(name))
+}
+
 // StmtGetMutation implements the sessionctx.Context interface.
 func (s *session) StmtGetMutation(tableID int64) *binlog.TableMutation {
 	st := &s.txn
@@ -0,0 +1,260 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package session
+
+import (
+	"testing"
+
+	"github.com/pingcap/tidb/kv"
+)
+
+func newTestTxnState(t *testing.T) *TxnState {
+	st := &TxnState{}
+	st.init()
+	return st
+}
+
+func mustGetBuffered(t *testing.T, st *TxnState, key string) (string, bool) {
+	t.Helper()
+	for _, buf := range st.allBuffers() {
+		v, err := buf.Get(kv.Key(key))
+		if err == nil {
+			return string(v), true
+		}
+		if !kv.IsErrNotFound(err) {
+			t.Fatalf("unexpected error reading %q: %v", key, err)
+		}
+	}
+	return "", false
+}
+
+// TestSavepointFoldKeepsStatementsSeparate reproduces the bug where folding a
+// statement's writes into the savepoint stack merged them directly into the
+// named savepoint's own frozen layer, so ROLLBACK TO SAVEPOINT (which only
+// ever resets the current layer) became a no-op for anything already folded
+// in by an earlier statement. Two statements are folded here on purpose: the
+// bug only showed up once more than one statement had folded into the same
+// savepoint.
+func TestSavepointFoldKeepsStatementsSeparate(t *testing.T) {
+	st := newTestTxnState(t)
+
+	st.Savepoint("sp1")
+
+	if err := st.Set(kv.Key("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.foldCurrentIntoStackTop(); err != nil {
+		t.Fatalf("fold after statement 1 failed: %v", err)
+	}
+
+	if err := st.Set(kv.Key("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.foldCurrentIntoStackTop(); err != nil {
+		t.Fatalf("fold after statement 2 failed: %v", err)
+	}
+
+	if len(st.savepoints) != 1 {
+		t.Fatalf("expected savepoint sp1 to still be open after folding later statements, got %d savepoints", len(st.savepoints))
+	}
+	if _, ok := mustGetBuffered(t, st, "b"); !ok {
+		t.Fatalf("expected key b written after the savepoint to be buffered")
+	}
+	if _, ok := mustGetBuffered(t, st, "c"); !ok {
+		t.Fatalf("expected key c written after the savepoint to be buffered")
+	}
+
+	if err := st.RollbackToSavepoint("sp1"); err != nil {
+		t.Fatalf("RollbackToSavepoint: %v", err)
+	}
+	if _, ok := mustGetBuffered(t, st, "b"); ok {
+		t.Fatalf("key b, folded in by the first statement after the savepoint, should have been discarded by ROLLBACK TO SAVEPOINT")
+	}
+	if _, ok := mustGetBuffered(t, st, "c"); ok {
+		t.Fatalf("key c, folded in by the second statement after the savepoint, should have been discarded by ROLLBACK TO SAVEPOINT")
+	}
+}
+
+// TestNestedSavepointFrozenSurvivesRollbackToInner checks that everything
+// folded in before a nested savepoint was created is unaffected by rolling
+// back to the nested one, which discards only the nested savepoint's own
+// frontier, and that rolling back to the enclosing savepoint discards it.
+func TestNestedSavepointFrozenSurvivesRollbackToInner(t *testing.T) {
+	st := newTestTxnState(t)
+
+	st.Savepoint("sp1")
+	if err := st.Set(kv.Key("b"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.foldCurrentIntoStackTop(); err != nil {
+		t.Fatalf("fold under sp1 failed: %v", err)
+	}
+
+	st.Savepoint("sp2")
+	if err := st.Set(kv.Key("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.foldCurrentIntoStackTop(); err != nil {
+		t.Fatalf("fold under sp2 failed: %v", err)
+	}
+
+	if _, ok := mustGetBuffered(t, st, "b"); !ok {
+		t.Fatalf("key b, written before sp2 existed, must be visible while sp2 is open")
+	}
+	if _, ok := mustGetBuffered(t, st, "c"); !ok {
+		t.Fatalf("key c, written under sp2, must be visible")
+	}
+
+	if err := st.RollbackToSavepoint("sp2"); err != nil {
+		t.Fatalf("RollbackToSavepoint sp2: %v", err)
+	}
+	if _, ok := mustGetBuffered(t, st, "c"); ok {
+		t.Fatalf("key c should have been discarded by ROLLBACK TO SAVEPOINT sp2")
+	}
+	if _, ok := mustGetBuffered(t, st, "b"); !ok {
+		t.Fatalf("key b, folded in under the enclosing sp1 before sp2 existed, must survive ROLLBACK TO SAVEPOINT sp2")
+	}
+
+	if err := st.RollbackToSavepoint("sp1"); err != nil {
+		t.Fatalf("RollbackToSavepoint sp1: %v", err)
+	}
+	if _, ok := mustGetBuffered(t, st, "b"); ok {
+		t.Fatalf("key b should have been discarded by ROLLBACK TO SAVEPOINT sp1")
+	}
+	if len(st.savepoints) != 1 {
+		t.Fatalf("expected ROLLBACK TO SAVEPOINT sp1 to discard sp2 and keep sp1, got %d savepoints", len(st.savepoints))
+	}
+}
+
+// TestRollbackToSavepointKeepsRecord reproduces the bug where
+// RollbackToSavepoint discarded the target savepoint itself, making a second
+// ROLLBACK TO, or a later RELEASE, of the same name fail.
+func TestRollbackToSavepointKeepsRecord(t *testing.T) {
+	st := newTestTxnState(t)
+	st.Savepoint("sp1")
+	if err := st.Set(kv.Key("x"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := st.RollbackToSavepoint("sp1"); err != nil {
+		t.Fatalf("first ROLLBACK TO SAVEPOINT sp1: %v", err)
+	}
+	if err := st.Set(kv.Key("y"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.RollbackToSavepoint("sp1"); err != nil {
+		t.Fatalf("second ROLLBACK TO SAVEPOINT sp1 should still find it: %v", err)
+	}
+	if err := st.ReleaseSavepoint("sp1"); err != nil {
+		t.Fatalf("RELEASE SAVEPOINT sp1 after rolling back to it: %v", err)
+	}
+	if len(st.savepoints) != 0 {
+		t.Fatalf("expected no savepoints left after RELEASE SAVEPOINT sp1, got %d", len(st.savepoints))
+	}
+}
+
+// TestReleaseSavepointMergesWrites checks that ReleaseSavepoint keeps the
+// writes made under the savepoint rather than discarding them.
+func TestReleaseSavepointMergesWrites(t *testing.T) {
+	st := newTestTxnState(t)
+	st.Savepoint("sp1")
+	if err := st.Set(kv.Key("x"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.foldCurrentIntoStackTop(); err != nil {
+		t.Fatalf("fold: %v", err)
+	}
+	if err := st.ReleaseSavepoint("sp1"); err != nil {
+		t.Fatalf("ReleaseSavepoint: %v", err)
+	}
+	if len(st.savepoints) != 0 {
+		t.Fatalf("expected the savepoint stack to be empty after release, got %d", len(st.savepoints))
+	}
+	if _, ok := mustGetBuffered(t, st, "x"); !ok {
+		t.Fatalf("key x written under the savepoint must survive RELEASE SAVEPOINT")
+	}
+}
+
+// TestReleaseAllSavepointsDrainsNestedStack checks the helper COMMIT relies
+// on to implicitly release any savepoints a transaction left open.
+func TestReleaseAllSavepointsDrainsNestedStack(t *testing.T) {
+	st := newTestTxnState(t)
+	st.Savepoint("sp1")
+	if err := st.Set(kv.Key("x"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.foldCurrentIntoStackTop(); err != nil {
+		t.Fatalf("fold under sp1 failed: %v", err)
+	}
+	st.Savepoint("sp2")
+	if err := st.Set(kv.Key("y"), []byte("2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.foldCurrentIntoStackTop(); err != nil {
+		t.Fatalf("fold under sp2 failed: %v", err)
+	}
+
+	if err := st.releaseAllSavepoints(); err != nil {
+		t.Fatalf("releaseAllSavepoints: %v", err)
+	}
+	if len(st.savepoints) != 0 {
+		t.Fatalf("expected an empty savepoint stack, got %d", len(st.savepoints))
+	}
+	if _, ok := mustGetBuffered(t, st, "x"); !ok {
+		t.Fatalf("key x must survive releaseAllSavepoints")
+	}
+	if _, ok := mustGetBuffered(t, st, "y"); !ok {
+		t.Fatalf("key y must survive releaseAllSavepoints")
+	}
+}
+
+// TestRollbackOrResetWithInvalidTransactionJustResets covers rollbackOrReset's
+// fallback branch: when Commit has already invalidated the transaction (or it
+// was never opened), rollbackOrReset must reset TxnState's own bookkeeping
+// rather than call Rollback on a nil Transaction. The Valid()==true branch,
+// which calls through to the real kv.Transaction.Rollback, needs a
+// kv.Transaction fake this package can't safely construct: the interface is
+// defined upstream and not vendored in this snapshot.
+func TestRollbackOrResetWithInvalidTransactionJustResets(t *testing.T) {
+	st := newTestTxnState(t)
+	st.Savepoint("sp1")
+	if err := st.Set(kv.Key("x"), []byte("1")); err != nil {
+		t.Fatal(err)
+	}
+
+	st.rollbackOrReset()
+
+	if len(st.savepoints) != 0 {
+		t.Fatalf("expected rollbackOrReset to clear the savepoint stack, got %d", len(st.savepoints))
+	}
+	if _, ok := mustGetBuffered(t, st, "x"); ok {
+		t.Fatalf("expected rollbackOrReset to discard buffered writes")
+	}
+}
+
+// TestFindSavepointMostRecentName matches MySQL's behaviour of resolving a
+// reused savepoint name to the most recently created one.
+func TestFindSavepointMostRecentName(t *testing.T) {
+	st := newTestTxnState(t)
+	st.Savepoint("sp")
+	st.Savepoint("sp")
+
+	idx, ok := st.findSavepoint("sp")
+	if !ok {
+		t.Fatalf("expected to find savepoint sp")
+	}
+	if idx != 1 {
+		t.Fatalf("expected the most recently created sp at index 1, got %d", idx)
+	}
+}
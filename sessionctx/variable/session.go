@@ -0,0 +1,54 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package variable holds per-session state and system variables. This file
+// only declares the subset of SessionVars that package session reads; it is
+// not a full copy of the real struct.
+package variable
+
+// UserIdentity identifies the user a session authenticated as.
+type UserIdentity struct {
+	Username string
+	Hostname string
+}
+
+// TransactionContext holds state scoped to the current transaction.
+type TransactionContext struct {
+	// SchemaVersion is the schema version the transaction's statements were
+	// compiled against.
+	SchemaVersion int64
+}
+
+// SessionVars holds session-scoped state and system variable values.
+type SessionVars struct {
+	// ConnectionID identifies the client connection this session serves.
+	ConnectionID uint64
+	// User is the identity the session authenticated as.
+	User *UserIdentity
+	// TxnCtx holds state scoped to the current transaction.
+	TxnCtx *TransactionContext
+	// TxnScope names a DC-local scope; BeginBatchReadOnly records it in the
+	// snapshot it opens, without restricting the snapshot's reads to it.
+	TxnScope string
+
+	// StmtCommitParallel mirrors the tidb_stmt_commit_parallel system
+	// variable: 0 disables StmtCommit's parallel flush path, a negative
+	// value means "use GOMAXPROCS", a positive value forces that many
+	// workers. See TxnState.SetCommitParallelism.
+	StmtCommitParallel int
+	// StmtCommitParallelThreshold mirrors the
+	// tidb_stmt_commit_parallel_threshold system variable: StmtCommit keeps
+	// its sequential flush path below this many buffered keys regardless of
+	// StmtCommitParallel.
+	StmtCommitParallelThreshold int
+}
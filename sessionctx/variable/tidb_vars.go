@@ -0,0 +1,28 @@
+// Copyright 2018 PingCAP, Inc.
+
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package variable
+
+// tidb_stmt_commit_parallel and tidb_stmt_commit_parallel_threshold control
+// TxnState's parallel StmtCommit flush; see SessionVars.StmtCommitParallel
+// and SessionVars.StmtCommitParallelThreshold.
+const (
+	TiDBStmtCommitParallel          = "tidb_stmt_commit_parallel"
+	TiDBStmtCommitParallelThreshold = "tidb_stmt_commit_parallel_threshold"
+)
+
+// Defaults for the system variables above.
+const (
+	DefTiDBStmtCommitParallel          = 0
+	DefTiDBStmtCommitParallelThreshold = 256
+)